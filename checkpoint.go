@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// checkpointState is periodically persisted so a multi-hour sweep can pick
+// back up close to where it left off after a restart or pod eviction. Each
+// node (plural only in Cluster mode) gets its own cursor, since SCAN cursors
+// are only meaningful within a single unbroken iteration against the node
+// that issued them.
+//
+// Done tracks, per node, whether its SCAN already ran to completion. This
+// can't be inferred from Cursors alone: Redis uses cursor 0 both to start an
+// iteration and to signal it's finished, so a saved cursor of 0 is
+// ambiguous between "never started" and "done" without it.
+//
+// Total only reflects keys processed by the run that last saved the
+// checkpoint, not a lifetime count across resumes — otherwise resuming a
+// sweep that already finished, or completed past --limit, would carry that
+// count forward and make every subsequent run an immediate no-op.
+//
+// Resumption is best-effort, not exactly-once: if the keyspace was resized
+// (nodes added/removed, or hash slots migrated) between runs, the saved
+// cursor may cause keys to be skipped or revisited.
+type checkpointState struct {
+	Pattern string          `json:"pattern"`
+	Total   int64           `json:"total"`
+	Cursors map[string]int  `json:"cursors"`
+	Done    map[string]bool `json:"done"`
+}
+
+var (
+	checkpointMu      sync.Mutex
+	currentCheckpoint = checkpointState{Cursors: map[string]int{}, Done: map[string]bool{}}
+
+	// checkpointConn is a connection dedicated to --checkpoint-key reads and
+	// writes, separate from any scanNode's conn since those are read/written
+	// from their own scanning goroutine and redigo connections aren't safe
+	// for concurrent use.
+	checkpointConn redis.Conn
+)
+
+// dialCheckpointConn dials whichever node main first hands it as a
+// connection to run --checkpoint-key's GET/SET against. That's only safe
+// because -cluster mode rejects -checkpoint-key at startup (see main.go) —
+// otherwise topo.nodes()[0] would be an arbitrary, nondeterministic master
+// that may not even own the checkpoint key's hash slot.
+func dialCheckpointConn(topo topology) (redis.Conn, error) {
+	if checkpointConn == nil {
+		conn, err := topo.nodes()[0].dial()
+		if err != nil {
+			return nil, err
+		}
+		checkpointConn = conn
+	}
+	return checkpointConn, nil
+}
+
+// updateCheckpoint records the latest cursor for node, whether its SCAN has
+// now run to completion, and the running total, called once all batches
+// dispatched before it, in SCAN order, have completed (see
+// checkpointWatermark) — never out of order.
+func updateCheckpoint(node string, cursor int, done bool, total int64) {
+	checkpointMu.Lock()
+	currentCheckpoint.Pattern = pattern
+	currentCheckpoint.Total = total
+	currentCheckpoint.Cursors[node] = cursor
+	if done {
+		currentCheckpoint.Done[node] = true
+	}
+	checkpointMu.Unlock()
+}
+
+// checkpointWatermark serializes checkpoint advancement for a single node's
+// SCAN loop against out-of-order worker completion. Batches are dispatched
+// to workers in SCAN order and tagged with a sequence number; a later batch
+// finishing before an earlier one must not advance the saved cursor past the
+// earlier batch's keys, since those were fetched but may not have actually
+// been DEL'd/EXPIRE'd yet. complete() only calls updateCheckpoint once every
+// batch up to and including the given sequence number has completed.
+type checkpointWatermark struct {
+	mu      sync.Mutex
+	next    int64
+	pending map[int64]int
+	done    map[int64]bool
+}
+
+func newCheckpointWatermark() *checkpointWatermark {
+	return &checkpointWatermark{pending: map[int64]int{}, done: map[int64]bool{}}
+}
+
+// complete records that the batch with the given sequence number and cursor
+// has finished processing, and advances the checkpoint for node past every
+// contiguous completed sequence starting from the oldest still outstanding.
+// done marks batch seq as the terminal SCAN reply for node (cursor wrapped
+// back to 0), distinguishing "this node is finished" from "never started"
+// once it's actually safe to record that.
+func (w *checkpointWatermark) complete(node string, seq int64, cursor int, done bool, total int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.pending[seq] = cursor
+	w.done[seq] = done
+	for {
+		cursor, ok := w.pending[w.next]
+		if !ok {
+			return
+		}
+		done := w.done[w.next]
+		delete(w.pending, w.next)
+		delete(w.done, w.next)
+		updateCheckpoint(node, cursor, done, total)
+		w.next++
+	}
+}
+
+// resumeCursor returns the saved cursor to resume node from, or 0 if there's
+// nothing to resume (no checkpoint, or it was taken for a different pattern).
+func resumeCursor(node string) int {
+	checkpointMu.Lock()
+	defer checkpointMu.Unlock()
+	if currentCheckpoint.Pattern != pattern {
+		return 0
+	}
+	return currentCheckpoint.Cursors[node]
+}
+
+// nodeDone reports whether node's SCAN already ran to completion according
+// to the loaded checkpoint, so a finished node isn't rescanned from scratch
+// on every resume just because its saved cursor reads 0.
+func nodeDone(node string) bool {
+	checkpointMu.Lock()
+	defer checkpointMu.Unlock()
+	if currentCheckpoint.Pattern != pattern {
+		return false
+	}
+	return currentCheckpoint.Done[node]
+}
+
+// loadCheckpoint populates currentCheckpoint from --checkpoint-file or
+// --checkpoint-key, if configured and present. A missing file/key, or one
+// that parses for a different pattern, just leaves scanning starting fresh.
+func loadCheckpoint(topo topology) {
+	var data []byte
+	var err error
+
+	switch {
+	case checkpointFile != "":
+		data, err = ioutil.ReadFile(checkpointFile)
+		if err != nil {
+			logger.debug.Println("No checkpoint file to resume from:", err)
+			return
+		}
+	case checkpointKey != "":
+		conn, dialErr := dialCheckpointConn(topo)
+		if dialErr != nil {
+			logger.info.Println("Failed to dial checkpoint connection:", dialErr)
+			return
+		}
+		data, err = redis.Bytes(conn.Do("GET", checkpointKey))
+		if err != nil {
+			logger.debug.Println("No checkpoint key to resume from:", err)
+			return
+		}
+	default:
+		return
+	}
+
+	var loaded checkpointState
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		logger.info.Println("Failed to parse checkpoint, starting fresh:", err)
+		return
+	}
+	if loaded.Pattern != pattern {
+		logger.info.Println("Checkpoint was taken for a different pattern, starting fresh")
+		return
+	}
+	if loaded.Done == nil {
+		loaded.Done = map[string]bool{}
+	}
+
+	checkpointMu.Lock()
+	currentCheckpoint = loaded
+	checkpointMu.Unlock()
+	logger.info.Println("Resuming from checkpoint: total=", loaded.Total, "cursors=", loaded.Cursors, "done=", loaded.Done)
+}
+
+// saveCheckpoint flushes currentCheckpoint to --checkpoint-file or
+// --checkpoint-key. It's a no-op if neither is configured.
+//
+// The periodic ticker, the SIGINT/SIGTERM handler and the final save in
+// main all call this from their own goroutine, so the whole read-marshal-
+// write sequence runs under checkpointMu, not just the marshal — redigo
+// connections, including checkpointConn, aren't safe for concurrent use.
+func saveCheckpoint(topo topology) {
+	if checkpointFile == "" && checkpointKey == "" {
+		return
+	}
+
+	checkpointMu.Lock()
+	defer checkpointMu.Unlock()
+
+	data, err := json.Marshal(currentCheckpoint)
+	if err != nil {
+		logger.info.Println("Failed to marshal checkpoint:", err)
+		return
+	}
+
+	if checkpointFile != "" {
+		if err := ioutil.WriteFile(checkpointFile, data, 0644); err != nil {
+			logger.info.Println("Failed to write checkpoint file:", err)
+		}
+		return
+	}
+
+	conn, err := dialCheckpointConn(topo)
+	if err != nil {
+		logger.info.Println("Failed to dial checkpoint connection:", err)
+		return
+	}
+	if _, err := conn.Do("SET", checkpointKey, data); err != nil {
+		logger.info.Println("Failed to write checkpoint key:", err)
+	}
+}
+
+// startPeriodicCheckpointing saves the checkpoint on a fixed interval in
+// addition to the signal-triggered and final saves, so progress survives a
+// SIGKILL or OOM-kill, not just a clean SIGINT/SIGTERM.
+func startPeriodicCheckpointing(topo topology, interval time.Duration) {
+	if checkpointFile == "" && checkpointKey == "" {
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			saveCheckpoint(topo)
+		}
+	}()
+}
+
+// installCheckpointSignalHandler saves the checkpoint and exits on
+// SIGINT/SIGTERM, so a multi-hour sweep can be restarted close to where it
+// was interrupted instead of from scratch.
+func installCheckpointSignalHandler(topo topology) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-sigs
+		logger.info.Println("Received", sig, "- saving checkpoint before exit")
+		saveCheckpoint(topo)
+		os.Exit(1)
+	}()
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	neturl "net/url"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// dialNodeURL connects to addr using the same scheme, auth and other
+// options -url carried (password, TLS via rediss://, DB index, …), just
+// with the host:port swapped out. Sentinel- and Cluster-resolved nodes are
+// otherwise just as likely to require auth/TLS as the seed node itself.
+//
+// Imported as neturl: the package-level -url flag variable already owns the
+// name url (see main.go), and package main can't have both.
+func dialNodeURL(baseURL string, addr string) (redis.Conn, error) {
+	u, err := neturl.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -url %q: %v", baseURL, err)
+	}
+	u.Host = addr
+	return redis.DialURL(u.String())
+}
+
+// scanNode is a single Redis endpoint that owns its own SCAN cursor. In
+// single-node and Sentinel mode there is exactly one; in Cluster mode there
+// is one per master, since Redis Cluster keyspaces are partitioned by hash
+// slot and SCAN only ever iterates the slots owned by the node it's sent to.
+type scanNode struct {
+	name string
+	conn redis.Conn
+
+	// dial opens a fresh connection to this same node, used to build the
+	// redis.Pool that worker goroutines pull pipelined connections from.
+	dial func() (redis.Conn, error)
+}
+
+// pool returns a redis.Pool of connections to this node, sized for
+// numWorkers concurrent pipelined workers.
+func (n *scanNode) pool(numWorkers int) *redis.Pool {
+	return &redis.Pool{
+		Dial:      n.dial,
+		MaxIdle:   numWorkers,
+		MaxActive: numWorkers,
+		Wait:      true,
+	}
+}
+
+// topology is the connection abstraction the worker pool and the SCAN loop work
+// against, so the rest of the program doesn't need to know whether it's
+// talking to a single Redis instance, a Sentinel-monitored master, or a
+// Cluster.
+type topology interface {
+	// nodes returns every node that needs to be scanned independently.
+	nodes() []*scanNode
+	close()
+}
+
+// singleTopology wraps a direct connection to one Redis server, dialed from
+// a redis:// URL.
+type singleTopology struct {
+	node *scanNode
+}
+
+func dialSingle(url string) (topology, error) {
+	conn, err := redis.DialURL(url)
+	if err != nil {
+		return nil, err
+	}
+	dial := func() (redis.Conn, error) { return redis.DialURL(url) }
+	return &singleTopology{node: &scanNode{name: url, conn: conn, dial: dial}}, nil
+}
+
+func (t *singleTopology) nodes() []*scanNode { return []*scanNode{t.node} }
+func (t *singleTopology) close()             { t.node.conn.Close() }
+
+// sentinelTopology resolves the current master for a monitored set via one
+// of the given Sentinel addresses, then connects to it directly. expiredis
+// never talks to Sentinel itself beyond that initial resolution.
+type sentinelTopology struct {
+	node *scanNode
+}
+
+// dialSentinel resolves the current master via Sentinel, then dials it with
+// the same auth/TLS options carried by url (the Sentinel control connection
+// itself is plain TCP, since Sentinel's own auth is typically separate from
+// the data nodes it monitors).
+func dialSentinel(url string, master string, addrs []string) (topology, error) {
+	if master == "" {
+		return nil, fmt.Errorf("-sentinel-master is required in sentinel mode")
+	}
+
+	var lastErr error
+	for _, addr := range addrs {
+		sentinelConn, err := redis.Dial("tcp", addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		reply, err := redis.Strings(sentinelConn.Do("SENTINEL", "get-master-addr-by-name", master))
+		sentinelConn.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(reply) != 2 {
+			lastErr = fmt.Errorf("unexpected SENTINEL reply: %v", reply)
+			continue
+		}
+
+		masterAddr := reply[0] + ":" + reply[1]
+		conn, err := dialNodeURL(url, masterAddr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		dial := func() (redis.Conn, error) { return dialNodeURL(url, masterAddr) }
+		return &sentinelTopology{node: &scanNode{name: masterAddr, conn: conn, dial: dial}}, nil
+	}
+
+	return nil, fmt.Errorf("failed to resolve master %q via sentinels %v: %v", master, addrs, lastErr)
+}
+
+func (t *sentinelTopology) nodes() []*scanNode { return []*scanNode{t.node} }
+func (t *sentinelTopology) close()             { t.node.conn.Close() }
+
+// clusterTopology connects directly to every master in a Redis Cluster,
+// discovered via CLUSTER SLOTS against a seed node, and scans each one
+// independently.
+type clusterTopology struct {
+	nodeList []*scanNode
+}
+
+func dialCluster(seedURL string) (topology, error) {
+	seed, err := redis.DialURL(seedURL)
+	if err != nil {
+		return nil, err
+	}
+	defer seed.Close()
+
+	slots, err := redis.Values(seed.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return nil, fmt.Errorf("CLUSTER SLOTS failed: %v", err)
+	}
+
+	masters := map[string]bool{}
+	for _, slotEntry := range slots {
+		slot, err := redis.Values(slotEntry, nil)
+		if err != nil || len(slot) < 3 {
+			continue
+		}
+		master, err := redis.Values(slot[2], nil)
+		if err != nil || len(master) < 2 {
+			continue
+		}
+		host, _ := redis.String(master[0], nil)
+		port, _ := redis.Int(master[1], nil)
+		if host == "" {
+			continue
+		}
+		masters[fmt.Sprintf("%s:%d", host, port)] = true
+	}
+
+	if len(masters) == 0 {
+		return nil, fmt.Errorf("CLUSTER SLOTS returned no masters; is %s actually a cluster node?", seedURL)
+	}
+
+	var nodeList []*scanNode
+	for addr := range masters {
+		addr := addr // capture for the dial closure
+		// Reuse -url's auth/TLS options for every master, same as the seed.
+		conn, err := dialNodeURL(seedURL, addr)
+		if err != nil {
+			for _, n := range nodeList {
+				n.conn.Close()
+			}
+			return nil, fmt.Errorf("failed to dial cluster master %s: %v", addr, err)
+		}
+		dial := func() (redis.Conn, error) { return dialNodeURL(seedURL, addr) }
+		nodeList = append(nodeList, &scanNode{name: addr, conn: conn, dial: dial})
+	}
+
+	return &clusterTopology{nodeList: nodeList}, nil
+}
+
+func (t *clusterTopology) nodes() []*scanNode { return t.nodeList }
+func (t *clusterTopology) close() {
+	for _, n := range t.nodeList {
+		n.conn.Close()
+	}
+}
+
+// dialTopology picks a topology implementation based on the sentinel/cluster
+// flags, falling back to a single direct connection to -url.
+func dialTopology(url string, cluster bool, sentinelMaster string, sentinelAddrs string) (topology, error) {
+	switch {
+	case cluster:
+		return dialCluster(url)
+	case sentinelMaster != "" || sentinelAddrs != "":
+		addrs := strings.Split(sentinelAddrs, ",")
+		return dialSentinel(url, sentinelMaster, addrs)
+	default:
+		return dialSingle(url)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"regexp"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// compiledRegex is --regex compiled once at startup, or nil if unset.
+var compiledRegex *regexp.Regexp
+
+// matchKeyName applies --regex against a key already matched by SCAN's
+// coarser MATCH glob. It runs client-side, before any round trip is spent on
+// a key, since it's the cheapest possible filter.
+func matchKeyName(key string) bool {
+	if compiledRegex == nil {
+		return true
+	}
+	return compiledRegex.MatchString(key)
+}
+
+// queueFilterCommands sends every server-side predicate enabled by flags
+// (--type, --min-idle, --min-memory, --lua-filter) for key, in a fixed
+// order, so they can be pipelined alongside the TTL fetch and read back with
+// a single Receive per command per key.
+func queueFilterCommands(conn redis.Conn, key string) {
+	if keyType != "" {
+		conn.Send("TYPE", key)
+	}
+	if minIdle >= 0 {
+		conn.Send("OBJECT", "IDLETIME", key)
+	}
+	if minMemory > 0 {
+		conn.Send("MEMORY", "USAGE", key)
+	}
+	if luaFilter != "" {
+		conn.Send("EVAL", luaFilter, 1, key)
+	}
+}
+
+// readFilterReplies reads back, in the same order queueFilterCommands sent
+// them, the replies for every enabled predicate and reports whether key
+// passes all of them.
+func readFilterReplies(conn redis.Conn, key string) (bool, error) {
+	ok := true
+
+	if keyType != "" {
+		reply, err := redis.String(conn.Receive())
+		if err != nil {
+			return false, err
+		}
+		if reply != keyType {
+			ok = false
+		}
+	}
+
+	if minIdle >= 0 {
+		idle, err := redis.Int(conn.Receive())
+		if err != nil {
+			return false, err
+		}
+		if idle < minIdle {
+			ok = false
+		}
+	}
+
+	if minMemory > 0 {
+		usage, err := redis.Int64(conn.Receive())
+		if err != nil {
+			return false, err
+		}
+		if usage < minMemory {
+			ok = false
+		}
+	}
+
+	if luaFilter != "" {
+		include, err := redis.Int(conn.Receive())
+		if err != nil {
+			return false, err
+		}
+		if include != 1 {
+			ok = false
+		}
+	}
+
+	if !ok {
+		logger.debug.Println("Key", key, "excluded by selection predicates")
+	}
+	return ok, nil
+}
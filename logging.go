@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// actionRecord is one structured log line emitted for every DEL/EXPIRE
+// decision when --log-format=json is set.
+type actionRecord struct {
+	Key    string `json:"key"`
+	Action string `json:"action"`
+	OldTTL int    `json:"old_ttl"`
+	NewTTL int    `json:"new_ttl"`
+	DryRun bool   `json:"dry_run"`
+}
+
+var jsonEncoder = json.NewEncoder(os.Stderr)
+
+// logAction records that action was taken (or would have been, in dry-run)
+// against key, either as a debug log line or, under --log-format=json, as a
+// structured record that a log pipeline can parse.
+func logAction(key, action string, oldTTL, newTTL int) {
+	if logFormat != "json" {
+		logger.debug.Println(action, "key", key, "oldTTL", oldTTL, "newTTL", newTTL)
+		return
+	}
+
+	jsonEncoder.Encode(actionRecord{
+		Key:    key,
+		Action: action,
+		OldTTL: oldTTL,
+		NewTTL: newTTL,
+		DryRun: dryRun,
+	})
+}
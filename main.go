@@ -4,28 +4,45 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"regexp"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/garyburd/redigo/redis"
 	"github.com/namsral/flag"
 )
 
 const NAME string = "expiredis"
 
 var (
-	verbose     bool
-	dryRun      bool
-	url         string
-	pattern     string
-	limit       int
-	count       int
-	delay       int64
-	ttlSubtract int
-	ttlSet      int
-	deleteKeys  bool
-	ttlMin      int
-	logger      struct {
+	verbose        bool
+	dryRun         bool
+	url            string
+	pattern        string
+	limit          int
+	count          int
+	delay          int64
+	ttlSubtract    int
+	ttlSet         int
+	deleteKeys     bool
+	ttlMin         int
+	cluster        bool
+	sentinelMaster string
+	sentinelAddrs  string
+	rate           float64
+	burst          int
+	limiter        *gcraLimiter
+	workers        int
+	keyType        string
+	regex          string
+	minIdle        int
+	minMemory      int64
+	luaFilter      string
+	metricsAddr    string
+	logFormat      string
+	checkpointFile string
+	checkpointKey  string
+	logger         struct {
 		debug *log.Logger
 		info  *log.Logger
 	}
@@ -46,6 +63,21 @@ func main() {
 	fs.IntVar(&ttlSubtract, "subtract-ttl", 0, "Seconds to subtract from TTL of matched keys")
 	fs.BoolVar(&deleteKeys, "delete", false, "Delete matched keys")
 	fs.IntVar(&ttlMin, "ttl-min", 0, "Minimum TTL for a key to be processed. Use -1 to match no TTL.")
+	fs.BoolVar(&cluster, "cluster", false, "Treat -url as a seed node and discover/scan every master in a Redis Cluster")
+	fs.StringVar(&sentinelMaster, "sentinel-master", "", "Name of the master set to resolve via Sentinel")
+	fs.StringVar(&sentinelAddrs, "sentinel-addrs", "", "Comma-separated host:port list of Sentinel addresses")
+	fs.Float64Var(&rate, "rate", 0, "Maximum rate of DEL/EXPIRE commands per second, 0 for unlimited")
+	fs.IntVar(&burst, "burst", 1, "Number of back-to-back requests allowed without waiting before --rate pacing kicks in")
+	fs.IntVar(&workers, "workers", 4, "Number of concurrent workers pipelining TTL/EXPIRE/DEL against each node")
+	fs.StringVar(&keyType, "type", "", "Only process keys of this TYPE (string/list/hash/set/zset/stream)")
+	fs.StringVar(&regex, "regex", "", "Regular expression a key must additionally match, applied after -pattern")
+	fs.IntVar(&minIdle, "min-idle", -1, "Minimum OBJECT IDLETIME in seconds for a key to be processed")
+	fs.Int64Var(&minMemory, "min-memory", 0, "Minimum MEMORY USAGE in bytes for a key to be processed")
+	fs.StringVar(&luaFilter, "lua-filter", "", "Lua script evaluated server-side with the key as KEYS[1]; must return 1 to include the key")
+	fs.StringVar(&metricsAddr, "metrics-addr", "", "Address to serve Prometheus metrics on (e.g. :9121); disabled if empty")
+	fs.StringVar(&logFormat, "log-format", "text", "Log format: text or json")
+	fs.StringVar(&checkpointFile, "checkpoint-file", "", "File to periodically persist the SCAN cursor(s) to, for resuming interrupted sweeps")
+	fs.StringVar(&checkpointKey, "checkpoint-key", "", "Redis key to periodically persist the SCAN cursor(s) to, instead of a file")
 	fs.Parse(os.Args[1:])
 
 	logger.debug = log.New(os.Stderr, "[debug] ", log.LstdFlags)
@@ -54,142 +86,75 @@ func main() {
 		logger.debug.SetOutput(ioutil.Discard)
 	}
 
-	c, err := redis.DialURL(url)
-	if err != nil {
-		logger.info.Fatal("Failed to connect to redis: ", err)
+	if workers < 1 {
+		logger.info.Fatal("-workers must be at least 1, got ", workers)
 	}
-	defer c.Close()
 
-	logger.info.Println("Connected to redis server at", url)
-	if dryRun {
-		logger.info.Println("Dry-run mode: destructive commands skipped")
+	if cluster && checkpointKey != "" {
+		logger.info.Fatal("-checkpoint-key isn't safe in -cluster mode: the key may not live on the master it happens to be written to; use -checkpoint-file instead")
 	}
 
-	done := make(chan func())
-	scan_stats := make(chan int, 0)
-	keys_stats := make(chan int, 0)
-	expired_stats := make(chan int, 0)
-	go stats(done, scan_stats, keys_stats, expired_stats)
-
-	var scan struct {
-		cursor   int
-		batch    []string
-		total    int
-		complete bool
+	if rate > 0 {
+		limiter = newGCRALimiter(rate, burst)
 	}
-	scan.cursor = 0
-	scan.total = 0
-
-	for {
-		result, err := redis.Values(c.Do("SCAN", scan.cursor, "MATCH", pattern, "COUNT", count))
-		if err != nil {
-			logger.info.Println("Failed to execute SCAN:", err)
-			time.Sleep(time.Second)
-			continue
-		}
 
-		_, err = redis.Scan(result, &scan.cursor, &scan.batch)
+	if regex != "" {
+		var err error
+		compiledRegex, err = regexp.Compile(regex)
 		if err != nil {
-			logger.info.Println("Failed to parse response:", err)
-			time.Sleep(time.Second)
-			continue
-		}
-
-		for _, key := range scan.batch {
-			scan.total++
-
-			if limit >= 0 && scan.total >= limit {
-				logger.info.Println("Reached limit of", limit, "keys")
-				scan.complete = true
-				break
-			}
-
-			if processKey(c, key) {
-				expired_stats <- 1
-			}
-		}
-
-		scan_stats <- 1
-		keys_stats <- len(scan.batch)
-
-		if scan.cursor == 0 || scan.complete {
-			break
-		}
-		logger.debug.Println("Next cursor is", scan.cursor)
-
-		if delay > 0 {
-			time.Sleep(time.Duration(delay) * time.Millisecond)
+			logger.info.Fatal("Invalid -regex: ", err)
 		}
 	}
 
-	// Read a callback from stats and call it to print final results
-	(<-done)()
-}
-
-func processKey(c redis.Conn, key string) (expired bool) {
-	var ttl int
-
-	// Only fetch TTL if we need it for minimum threshold or subtracting
-	if ttlMin != 0 || ttlSubtract != 0 {
-		result, err := redis.Int(c.Do("TTL", key))
-		if err != nil {
-			logger.info.Println("Failed to get TTL for key", key)
-			return
-		}
-		ttl = result
-
-		logger.debug.Println("TTL of", ttl, "for key", key)
+	initMetrics()
+	if metricsAddr != "" {
+		serveMetrics(metricsAddr)
 	}
 
-	if !matchTTL(ttl, ttlMin) {
-		logger.debug.Println("TTL", ttl, "doesn't match minimum TTL", ttlMin)
-		return
+	topo, err := dialTopology(url, cluster, sentinelMaster, sentinelAddrs)
+	if err != nil {
+		logger.info.Fatal("Failed to connect to redis: ", err)
 	}
+	defer topo.close()
 
-	if deleteKeys {
-		if dryRun {
-			return true
-		}
-
-		_, err := c.Do("DEL", key)
-		if err != nil {
-			logger.info.Println("Failed to DELETE key", key, err)
-			return
-		}
+	logger.info.Println("Connected to redis at", url)
+	if dryRun {
+		logger.info.Println("Dry-run mode: destructive commands skipped")
+	}
 
-		logger.debug.Println("Deleted key", key)
-		return true
+	loadCheckpoint(topo)
+	installCheckpointSignalHandler(topo)
+	startPeriodicCheckpointing(topo, 30*time.Second)
 
-	}
+	done := make(chan func())
+	scan_stats := make(chan int, 0)
+	keys_stats := make(chan int, 0)
+	expired_stats := make(chan int, 0)
+	go stats(done, scan_stats, keys_stats, expired_stats)
 
-	if ttlSubtract > 0 {
-		if dryRun {
-			return true
+	// Every node iterates its own SCAN cursor; a key only ever lives on one
+	// node, so there's nothing to merge beyond the totals. total always
+	// starts fresh, even when resuming from a checkpoint: --limit caps how
+	// many keys *this run* processes, and carrying a prior run's count
+	// forward would make every resume of an already-finished (or
+	// already-limited) sweep silently process nothing.
+	var total int64
+	for _, node := range topo.nodes() {
+		if nodeDone(node.name) {
+			logger.info.Println("Node", node.name, "already completed per checkpoint, skipping")
+			continue
 		}
-		newTTL := ttl - ttlSubtract
-		_, err := c.Do("EXPIRE", key, newTTL)
-		if err != nil {
-			logger.info.Println("Failed to EXPIRE key", key, err)
-			return
+		logger.info.Println("Scanning node", node.name, "with", workers, "workers")
+		processNodeConcurrently(node, workers, &total, scan_stats, keys_stats, expired_stats)
+		if limit >= 0 && atomic.LoadInt64(&total) >= int64(limit) {
+			break
 		}
-		logger.debug.Println("new TTL of", newTTL, "for key", key)
-		return true
 	}
 
-	if ttlSet > 0 {
-		if dryRun {
-			return true
-		}
-		_, err := c.Do("EXPIRE", key, ttlSet)
-		if err != nil {
-			logger.info.Println("Failed to EXPIRE key", key, err)
-			return
-		}
-		logger.debug.Println("new TTL of", ttlSet, "for key", key)
-		return true
-	}
+	saveCheckpoint(topo)
 
-	return
+	// Read a callback from stats and call it to print final results
+	(<-done)()
 }
 
 func matchTTL(ttl int, ttlMin int) bool {
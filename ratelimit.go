@@ -0,0 +1,50 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// gcraLimiter is a GCRA (generic cell rate algorithm) token bucket used to
+// cap the rate of destructive commands (DEL/EXPIRE) independently of the
+// coarser --delay sleep between batches. It tracks a "theoretical arrival
+// time" (TAT) for the next request: each call advances the TAT by one
+// emission interval, and if that puts the TAT further than burst intervals
+// ahead of now, the call blocks until it's back within the allowance.
+type gcraLimiter struct {
+	mu       sync.Mutex
+	emission time.Duration // time between requests at the target rate
+	burst    int           // number of emission intervals of spike allowed
+	tat      time.Time
+	hasTat   bool
+}
+
+// newGCRALimiter builds a limiter allowing up to rate ops/sec, with up to
+// burst back-to-back requests (counting the first) serviced without waiting.
+func newGCRALimiter(rate float64, burst int) *gcraLimiter {
+	return &gcraLimiter{
+		emission: time.Duration(float64(time.Second) / rate),
+		burst:    burst,
+	}
+}
+
+// wait blocks, if necessary, until the next request is allowed to proceed
+// under the configured rate and burst allowance.
+func (l *gcraLimiter) wait() {
+	l.mu.Lock()
+	now := time.Now()
+
+	tat := now
+	if l.hasTat && l.tat.After(now) {
+		tat = l.tat
+	}
+	newTat := tat.Add(l.emission)
+	l.tat = newTat
+	l.hasTat = true
+	l.mu.Unlock()
+
+	allowance := time.Duration(l.burst) * l.emission
+	if diff := newTat.Sub(now); diff > allowance {
+		time.Sleep(diff - allowance)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestGCRALimiterBurst checks that up to --burst calls proceed without
+// blocking, since they're serviced from the spike allowance instead of
+// waiting for the steady-state emission interval.
+func TestGCRALimiterBurst(t *testing.T) {
+	l := newGCRALimiter(100, 5) // 100/sec => 10ms emission, burst of 5
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		l.wait()
+	}
+	elapsed := time.Since(start)
+
+	if elapsed > 20*time.Millisecond {
+		t.Errorf("expected %d burst calls to return immediately, took %v", 5, elapsed)
+	}
+}
+
+// TestGCRALimiterPacesPastBurst checks that once the burst allowance is
+// exhausted, further calls block to hold the call rate at roughly the
+// configured emission interval.
+func TestGCRALimiterPacesPastBurst(t *testing.T) {
+	l := newGCRALimiter(100, 1) // 100/sec => 10ms emission, burst of 1
+
+	l.wait() // consumes the single burst slot
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		l.wait()
+	}
+	elapsed := time.Since(start)
+
+	// 3 calls at a 10ms emission interval should take at least ~30ms, with
+	// some slack for scheduling jitter on a loaded test machine.
+	if elapsed < 25*time.Millisecond {
+		t.Errorf("expected pacing to hold back 3 calls to ~30ms, took %v", elapsed)
+	}
+}
+
+// TestGCRALimiterRecoversAllowanceOverTime checks that waiting longer than
+// the emission interval between calls lets the burst allowance refill,
+// instead of being stuck paying for a stale TAT forever.
+func TestGCRALimiterRecoversAllowanceOverTime(t *testing.T) {
+	l := newGCRALimiter(100, 1) // 100/sec => 10ms emission, burst of 1
+
+	l.wait()
+	time.Sleep(20 * time.Millisecond) // let the allowance fully recover
+
+	start := time.Now()
+	l.wait()
+	elapsed := time.Since(start)
+
+	if elapsed > 5*time.Millisecond {
+		t.Errorf("expected a call after the allowance recovered to return immediately, took %v", elapsed)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// keyBatch is one SCAN reply's worth of keys, handed from the scanning
+// goroutine to the worker pool. cursor is the cursor SCAN returned for this
+// reply, i.e. what resuming should pick up from once this batch's keys have
+// actually been processed. seq is this batch's position in SCAN order,
+// used by checkpointWatermark to keep checkpoint advancement in order even
+// though workers can finish batches out of order. done reports whether this
+// reply's cursor wrapped back to 0, i.e. this node's SCAN is now complete.
+type keyBatch struct {
+	keys   []string
+	cursor int
+	seq    int64
+	done   bool
+}
+
+// processNodeConcurrently drives SCAN against node on its own goroutine,
+// pushing batches onto a channel that numWorkers pooled-connection workers
+// drain concurrently. Each worker fetches TTLs (and, without --rate, applies
+// DEL/EXPIRE) for its whole batch with one pipelined round trip each, instead
+// of 1-2 RTTs per key. total is shared across nodes and updated atomically so the
+// --limit check stays correct under concurrency.
+func processNodeConcurrently(node *scanNode, numWorkers int, total *int64, scanStats, keysStats, expiredStats chan int) {
+	pool := node.pool(numWorkers)
+	defer pool.Close()
+
+	batches := make(chan keyBatch, numWorkers)
+	watermark := newCheckpointWatermark()
+
+	var wg sync.WaitGroup
+	wg.Add(numWorkers)
+	for i := 0; i < numWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				matched, expired := processBatchPipelined(pool, batch.keys, total)
+				keysStats <- len(batch.keys)
+				expiredStats <- expired
+				_ = matched
+
+				// Only checkpoint past this batch once every
+				// earlier-dispatched batch has also completed, so a
+				// kill mid-sweep can never skip a still-in-flight batch.
+				watermark.complete(node.name, batch.seq, batch.cursor, batch.done, atomic.LoadInt64(total))
+			}
+		}()
+	}
+
+	runScan(node, total, scanStats, batches)
+	close(batches)
+	wg.Wait()
+}
+
+// runScan issues SCAN against node until its cursor wraps to 0 or total
+// reaches --limit, pushing each batch of keys onto batches. It resumes from
+// a checkpointed cursor for this node, if one was loaded at startup.
+func runScan(node *scanNode, total *int64, scanStats chan int, batches chan<- keyBatch) {
+	conn := node.conn
+	cursor := resumeCursor(node.name)
+	if cursor != 0 {
+		logger.info.Println("Resuming node", node.name, "from cursor", cursor)
+	}
+
+	var seq int64
+
+	for {
+		result, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", count))
+		if err != nil {
+			logger.info.Println("Failed to execute SCAN:", err)
+			metricsRedisErrors.Inc()
+			time.Sleep(time.Second)
+			continue
+		}
+
+		var keys []string
+		_, err = redis.Scan(result, &cursor, &keys)
+		if err != nil {
+			logger.info.Println("Failed to parse response:", err)
+			metricsRedisErrors.Inc()
+			time.Sleep(time.Second)
+			continue
+		}
+
+		if limit >= 0 {
+			remaining := int64(limit) - atomic.LoadInt64(total)
+			if remaining <= 0 {
+				logger.info.Println("Reached limit of", limit, "keys")
+				return
+			}
+			if int64(len(keys)) > remaining {
+				keys = keys[:remaining]
+			}
+		}
+
+		atomic.AddInt64(total, int64(len(keys)))
+		metricsKeysScanned.Add(float64(len(keys)))
+		scanStats <- 1
+		// Dispatch every reply, even an empty one, so the watermark sees a
+		// contiguous sequence and the final cursor (including 0, meaning
+		// this node is done) only gets checkpointed once everything before
+		// it has actually completed.
+		batches <- keyBatch{keys: keys, cursor: cursor, seq: seq, done: cursor == 0}
+		seq++
+
+		if cursor == 0 {
+			return
+		}
+		logger.debug.Println("Next cursor is", cursor)
+
+		if delay > 0 {
+			time.Sleep(time.Duration(delay) * time.Millisecond)
+		}
+	}
+}
+
+// processBatchPipelined runs the selection predicates (TTL, --type,
+// --min-idle, --min-memory, --lua-filter) for every key in one pipelined
+// round trip, then applies DEL/EXPIRE for the keys that pass via
+// applyActions: a second round trip wrapped in MULTI/EXEC, or one round trip
+// per key when --rate is set.
+func processBatchPipelined(pool *redis.Pool, keys []string, total *int64) (matched int, expired int) {
+	batchStart := time.Now()
+	defer func() { metricsBatchLatency.Observe(time.Since(batchStart).Seconds()) }()
+
+	// --regex runs client-side, so prune before spending any round trip.
+	filtered := keys[:0:0]
+	for _, key := range keys {
+		if matchKeyName(key) {
+			filtered = append(filtered, key)
+		}
+	}
+	keys = filtered
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	needsTTL := ttlMin != 0 || ttlSubtract != 0
+
+	for _, key := range keys {
+		if needsTTL {
+			conn.Send("TTL", key)
+		}
+		queueFilterCommands(conn, key)
+	}
+	conn.Flush()
+
+	ttls := make([]int, len(keys))
+	passed := make([]bool, len(keys))
+	for i, key := range keys {
+		passed[i] = true
+		if needsTTL {
+			ttl, err := redis.Int(conn.Receive())
+			if err != nil {
+				logger.info.Println("Failed to get TTL for key", key)
+				metricsRedisErrors.Inc()
+				passed[i] = false
+			}
+			ttls[i] = ttl
+		}
+
+		ok, err := readFilterReplies(conn, key)
+		if err != nil {
+			logger.info.Println("Failed to evaluate selection predicates for key", key, err)
+			metricsRedisErrors.Inc()
+			passed[i] = false
+		} else if !ok {
+			passed[i] = false
+		}
+	}
+
+	var toAct []string
+	actTTL := make(map[string]int)
+	for i, key := range keys {
+		if !passed[i] {
+			continue
+		}
+		if !matchTTL(ttls[i], ttlMin) {
+			logger.debug.Println("TTL", ttls[i], "doesn't match minimum TTL", ttlMin)
+			continue
+		}
+		matched++
+		if needsTTL {
+			metricsTTLSeconds.Observe(float64(ttls[i]))
+		}
+		toAct = append(toAct, key)
+		actTTL[key] = ttls[i]
+	}
+	metricsKeysMatched.Add(float64(matched))
+
+	// Only one of -delete/-subtract-ttl/-set-ttl is applied per run (see
+	// actionFor for which wins when several are set); a run with none of them set is a legitimate "just evaluate my filters" pass (see
+	// -type/-regex/-min-idle/-min-memory/-lua-filter), which must not log or
+	// count keys as expired/deleted since nothing was actually applied.
+	hasAction := deleteKeys || ttlSubtract > 0 || ttlSet > 0
+	if !hasAction || len(toAct) == 0 {
+		return matched, 0
+	}
+
+	action, newTTL := actionFor()
+
+	if dryRun {
+		for _, key := range toAct {
+			keyNewTTL := newTTL
+			if ttlSubtract > 0 {
+				keyNewTTL = actTTL[key] - ttlSubtract
+			}
+			logAction(key, action, actTTL[key], keyNewTTL)
+		}
+		return matched, len(toAct)
+	}
+
+	applied, err := applyActions(conn, toAct, actTTL)
+	toAct = applied
+	if err != nil {
+		logger.info.Println("Failed to apply", action, "to batch:", err)
+		metricsRedisErrors.Inc()
+		return matched, len(applied)
+	}
+
+	for _, key := range toAct {
+		keyNewTTL := newTTL
+		if ttlSubtract > 0 {
+			keyNewTTL = actTTL[key] - ttlSubtract
+		}
+		logAction(key, action, actTTL[key], keyNewTTL)
+	}
+
+	if deleteKeys {
+		metricsKeysDeleted.Add(float64(len(toAct)))
+	} else {
+		metricsKeysExpired.Add(float64(len(toAct)))
+	}
+
+	logger.debug.Println("Applied", action, "to", len(toAct), "keys")
+	return matched, len(toAct)
+}
+
+// actionFor reports the single action this batch is taking (delete, else
+// subtract-ttl, else set-ttl, when more than one is set) and, for set-ttl,
+// the fixed new TTL every key gets.
+func actionFor() (action string, newTTL int) {
+	switch {
+	case deleteKeys:
+		return "delete", 0
+	case ttlSubtract > 0:
+		return "subtract-ttl", 0
+	default:
+		return "set-ttl", ttlSet
+	}
+}
+
+// sendAction queues the single DEL/EXPIRE command this run applies for key
+// into conn's output buffer, without flushing or reading a reply.
+func sendAction(conn redis.Conn, key string, actTTL map[string]int) {
+	switch {
+	case deleteKeys:
+		conn.Send("DEL", key)
+	case ttlSubtract > 0:
+		conn.Send("EXPIRE", key, actTTL[key]-ttlSubtract)
+	case ttlSet > 0:
+		conn.Send("EXPIRE", key, ttlSet)
+	}
+}
+
+// doAction issues the single DEL/EXPIRE command this run applies for key as
+// its own round trip, waiting for the reply.
+func doAction(conn redis.Conn, key string, actTTL map[string]int) (interface{}, error) {
+	switch {
+	case deleteKeys:
+		return conn.Do("DEL", key)
+	case ttlSubtract > 0:
+		return conn.Do("EXPIRE", key, actTTL[key]-ttlSubtract)
+	default:
+		return conn.Do("EXPIRE", key, ttlSet)
+	}
+}
+
+// applyActions issues the configured DEL/EXPIRE action for every key in
+// toAct, returning the keys it actually confirmed applied.
+//
+// With no --rate limiter, the whole batch is queued in a single MULTI/EXEC
+// round trip for throughput. With a limiter configured, each key is instead
+// dispatched as its own round trip gated by limiter.wait() immediately
+// beforehand — pipelining the batch and only pacing how fast it's queued
+// would still let Redis execute every command back-to-back the instant EXEC
+// arrives, defeating the point of rate limiting.
+func applyActions(conn redis.Conn, toAct []string, actTTL map[string]int) (applied []string, err error) {
+	if limiter == nil {
+		conn.Send("MULTI")
+		for _, key := range toAct {
+			sendAction(conn, key, actTTL)
+		}
+		replies, err := redis.Values(conn.Do("EXEC"))
+		if err != nil {
+			return nil, err
+		}
+		for i, reply := range replies {
+			if i >= len(toAct) {
+				break
+			}
+			if replyErr, ok := reply.(redis.Error); ok {
+				logger.info.Println("Failed to apply action to key", toAct[i], ":", replyErr)
+				metricsRedisErrors.Inc()
+				continue
+			}
+			applied = append(applied, toAct[i])
+		}
+		return applied, nil
+	}
+
+	for _, key := range toAct {
+		limiter.wait()
+		if _, err := doAction(conn, key, actTTL); err != nil {
+			logger.info.Println("Failed to apply action to key", key, ":", err)
+			metricsRedisErrors.Inc()
+			continue
+		}
+		applied = append(applied, key)
+	}
+	return applied, nil
+}